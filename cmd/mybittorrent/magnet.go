@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// MagnetLink is the parsed form of a `magnet:?xt=urn:btih:...` URI: enough
+// to start a peer conversation and fetch the info dict without ever reading
+// a .torrent file.
+type MagnetLink struct {
+	infoHash    string
+	displayName string
+	trackers    []string
+}
+
+// parseMagnetLink parses a magnet URI of the form
+// `magnet:?xt=urn:btih:<info-hash>&dn=<name>&tr=<tracker>&tr=<tracker>...`.
+func parseMagnetLink(uri string) (MagnetLink, error) {
+	const magnetPrefix = "magnet:?"
+	if !strings.HasPrefix(uri, magnetPrefix) {
+		return MagnetLink{}, fmt.Errorf("not a magnet link: %q", uri)
+	}
+
+	values, err := url.ParseQuery(strings.TrimPrefix(uri, magnetPrefix))
+	if err != nil {
+		return MagnetLink{}, err
+	}
+
+	const btihPrefix = "urn:btih:"
+	xt := values.Get("xt")
+	if !strings.HasPrefix(xt, btihPrefix) {
+		return MagnetLink{}, fmt.Errorf("unsupported magnet xt value: %q", xt)
+	}
+
+	return MagnetLink{
+		infoHash:    strings.ToLower(strings.TrimPrefix(xt, btihPrefix)),
+		displayName: values.Get("dn"),
+		trackers:    values["tr"],
+	}, nil
+}
+
+// extensionReservedBytes returns the handshake reserved-bytes field with the
+// BEP 10 extension protocol bit set (reserved byte 5, bit 0x10 - bit 20 of
+// the 64-bit reserved field).
+func extensionReservedBytes() [8]byte {
+	var reserved [8]byte
+	reserved[5] = 0x10
+	return reserved
+}
+
+// supportsExtensions reports whether a handshake's reserved bytes advertise
+// BEP 10 extension protocol support.
+func supportsExtensions(reserved [8]byte) bool {
+	return reserved[5]&0x10 != 0
+}
+
+// sendExtendedHandshake sends our BEP 10 extended handshake, advertising
+// the ut_metadata (BEP 9) extension under UT_METADATA_EXTENSION_ID.
+func sendExtendedHandshake(conn net.Conn) error {
+	var payload bytes.Buffer
+	dict := map[string]interface{}{
+		"m": map[string]interface{}{
+			"ut_metadata": UT_METADATA_EXTENSION_ID,
+		},
+	}
+
+	if err := bencode.Marshal(&payload, dict); err != nil {
+		return err
+	}
+
+	message := append([]byte{EXTENDED_MESSAGE_ID, EXTENDED_HANDSHAKE_ID}, payload.Bytes()...)
+	return writeFramedMessage(conn, message)
+}
+
+// readExtendedHandshake reads a peer's BEP 10 extended handshake and
+// returns the ut_metadata extension id it advertises and the metadata size
+// it reports, if any. Peers commonly send other messages (bitfield, have,
+// ...) before the extended handshake, so those are skipped rather than
+// treated as an error.
+func readExtendedHandshake(conn net.Conn) (peerUtMetadataId int, metadataSize int, err error) {
+	var payload []byte
+	for {
+		payload, err = readFramedMessage(conn)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if len(payload) == 0 {
+			continue // keep-alive
+		}
+
+		if payload[0] == EXTENDED_MESSAGE_ID {
+			break
+		}
+	}
+
+	if payload[1] != EXTENDED_HANDSHAKE_ID {
+		return 0, 0, fmt.Errorf("expected extended handshake, got sub-id %d", payload[1])
+	}
+
+	decoded, _, err := decodeDict(string(payload[2:]), 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	m, ok := decoded["m"].(map[string]interface{})
+	if !ok {
+		return 0, 0, fmt.Errorf("extended handshake is missing the m dict")
+	}
+
+	peerUtMetadataId, ok = m["ut_metadata"].(int)
+	if !ok {
+		return 0, 0, fmt.Errorf("peer does not support ut_metadata")
+	}
+
+	metadataSize, _ = decoded["metadata_size"].(int)
+
+	return peerUtMetadataId, metadataSize, nil
+}
+
+// requestMetadataPiece sends a ut_metadata request (msg_type 0) for the
+// given 16 KiB metadata piece, addressed to peerUtMetadataId - the
+// extension id the peer itself advertised for ut_metadata.
+func requestMetadataPiece(conn net.Conn, peerUtMetadataId int, pieceIndex int) error {
+	var payload bytes.Buffer
+	dict := map[string]interface{}{
+		"msg_type": 0,
+		"piece":    pieceIndex,
+	}
+
+	if err := bencode.Marshal(&payload, dict); err != nil {
+		return err
+	}
+
+	message := append([]byte{EXTENDED_MESSAGE_ID, byte(peerUtMetadataId)}, payload.Bytes()...)
+	return writeFramedMessage(conn, message)
+}
+
+// readMetadataPiece reads a ut_metadata data (msg_type 1) or reject
+// (msg_type 2) message and returns the piece index and, for data messages,
+// the raw metadata bytes that follow the bencoded header.
+func readMetadataPiece(conn net.Conn) (pieceIndex int, data []byte, err error) {
+	payload, err := readFramedMessage(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if payload[0] != EXTENDED_MESSAGE_ID {
+		return 0, nil, fmt.Errorf("expected extended message, got id %d", payload[0])
+	}
+
+	dict, consumed, err := decodeDict(string(payload[1:]), 0)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	msgType, _ := dict["msg_type"].(int)
+	pieceIndex, _ = dict["piece"].(int)
+
+	switch msgType {
+	case 1:
+		return pieceIndex, payload[1+consumed:], nil
+	case 2:
+		return pieceIndex, nil, fmt.Errorf("peer rejected metadata piece %d", pieceIndex)
+	default:
+		return pieceIndex, nil, fmt.Errorf("expected metadata data message, got msg_type %d", msgType)
+	}
+}
+
+// fetchMetadataFromPeer performs the handshake + BEP 10/9 extension
+// handshake with a single peer and downloads the full info dict in 16 KiB
+// chunks, verifying its SHA-1 against the magnet link's info hash.
+func fetchMetadataFromPeer(peer Peer, infoHashHex string) ([]byte, error) {
+	hexDecodedHash, err := hex.DecodeString(infoHashHex)
+	if err != nil {
+		return nil, err
+	}
+
+	handshakeMessage := HandshakeMessage{
+		Length:        19,
+		Protocol:      "BitTorrent protocol",
+		ReservedBytes: extensionReservedBytes(),
+		InfoHash:      string(hexDecodedHash),
+		PeerId:        "00112233445566778899",
+	}
+
+	peerAddress := fmt.Sprintf("%s:%d", peer.IP.String(), peer.Port)
+	conn, err := net.Dial("tcp", peerAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	handshakeResponse := performHandshake(conn, handshakeMessage.getBytes())
+	if !supportsExtensions(handshakeResponse.ReservedBytes) {
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	if err := sendExtendedHandshake(conn); err != nil {
+		return nil, err
+	}
+
+	peerUtMetadataId, metadataSize, err := readExtendedHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	numPieces := int(math.Ceil(float64(metadataSize) / float64(BLOCK_SIZE)))
+	metadata := make([]byte, metadataSize)
+
+	for piece := 0; piece < numPieces; piece++ {
+		if err := requestMetadataPiece(conn, peerUtMetadataId, piece); err != nil {
+			return nil, err
+		}
+
+		receivedPiece, data, err := readMetadataPiece(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if receivedPiece != piece {
+			return nil, fmt.Errorf("expected metadata piece %d, got %d", piece, receivedPiece)
+		}
+
+		copy(metadata[piece*BLOCK_SIZE:], data)
+	}
+
+	actualHash := fmt.Sprintf("%x", sha1.Sum(metadata))
+	if actualHash != infoHashHex {
+		return nil, fmt.Errorf("metadata hash %s does not match magnet info hash %s", actualHash, infoHashHex)
+	}
+
+	return metadata, nil
+}
+
+// fetchTorrentFromMagnet resolves a magnet URI into a full ParsedTorrentFile
+// by discovering a peer via the magnet's tracker and fetching the info dict
+// from it over BEP 9 ut_metadata.
+func fetchTorrentFromMagnet(uri string) (ParsedTorrentFile, error) {
+	magnetLink, err := parseMagnetLink(uri)
+	if err != nil {
+		return ParsedTorrentFile{}, err
+	}
+
+	if len(magnetLink.trackers) == 0 {
+		return ParsedTorrentFile{}, fmt.Errorf("magnet link has no trackers")
+	}
+
+	trackerUrl := magnetLink.trackers[0]
+
+	hexDecodedHash, err := hex.DecodeString(magnetLink.infoHash)
+	if err != nil {
+		return ParsedTorrentFile{}, err
+	}
+
+	finalUrl := getPeerDiscoveryUrl(
+		string(hexDecodedHash),
+		"00112233445566778899",
+		"6881",
+		"0",
+		"0",
+		999, // total length is unknown until the info dict is fetched
+		"1",
+		trackerUrl,
+	)
+
+	peers := performPeerDiscovery(finalUrl)
+	if len(peers) == 0 {
+		return ParsedTorrentFile{}, fmt.Errorf("no peers returned by tracker")
+	}
+
+	metadata, err := fetchMetadataFromPeer(peers[0], magnetLink.infoHash)
+	if err != nil {
+		return ParsedTorrentFile{}, err
+	}
+
+	info, _, err := decodeDict(string(metadata), 0)
+	if err != nil {
+		return ParsedTorrentFile{}, err
+	}
+
+	return parsedTorrentFromInfoDict(trackerUrl, info)
+}
+
+func writeFramedMessage(conn net.Conn, message []byte) error {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(message)))
+
+	_, err := conn.Write(append(length, message...))
+	return err
+}
+
+func readFramedMessage(conn net.Conn) ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBytes)
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"unicode"
 
@@ -30,9 +31,22 @@ type ParsedTorrentFile struct {
 }
 
 type TorrentInfo struct {
+	name        string
 	length      int
 	pieceLength int
 	pieces      []string
+	files       []TorrentFileInfo // non-nil for multi-file torrents
+}
+
+// TorrentFileInfo describes a single file within a multi-file torrent, as
+// found in the info dict's "files" list.
+type TorrentFileInfo struct {
+	length int
+	path   []string
+}
+
+func (t TorrentInfo) isMultiFile() bool {
+	return t.files != nil
 }
 
 type TrackerResponse struct {
@@ -69,12 +83,22 @@ type HandshakeMessage struct {
 }
 
 const (
-	BIT_FIELD_MESSAGE_ID  = 5
-	INTERESTED_MESSAGE_ID = 2
-	UNCHOKE_MESSAGE_ID    = 1
-	BLOCK_SIZE            = 16 * 1024
-	REQUEST_MESSAGE_ID    = 6
-	PIECE_MESSAGE_ID      = 7
+	CHOKE_MESSAGE_ID          = 0
+	UNCHOKE_MESSAGE_ID        = 1
+	INTERESTED_MESSAGE_ID     = 2
+	NOT_INTERESTED_MESSAGE_ID = 3
+	BIT_FIELD_MESSAGE_ID      = 5
+	BLOCK_SIZE                = 16 * 1024
+	REQUEST_MESSAGE_ID        = 6
+	PIECE_MESSAGE_ID          = 7
+	EXTENDED_MESSAGE_ID       = 20
+
+	// BEP 10 extension protocol bookkeeping: EXTENDED_HANDSHAKE_ID is the
+	// sub-message id reserved for the extended handshake itself, and
+	// UT_METADATA_EXTENSION_ID is the id we advertise for ut_metadata (BEP
+	// 9) in our own extended handshake's "m" dict.
+	EXTENDED_HANDSHAKE_ID    = 0
+	UT_METADATA_EXTENSION_ID = 1
 )
 
 func decodeBencode(bencodedString string, st int) (x interface{}, i int, err error) {
@@ -215,11 +239,12 @@ func decodeNumber(bencodedString string, st int) (int, int, error) {
 }
 
 func main() {
-	command := os.Args[1]
+	storageKind, args := parseStorageFlag(os.Args[1:])
+	command := args[0]
 
 	switch command {
 	case "decode":
-		bencodedValue := os.Args[2]
+		bencodedValue := args[1]
 
 		decoded, _, err := decodeBencode(bencodedValue, 0)
 		if err != nil {
@@ -230,7 +255,7 @@ func main() {
 		jsonOutput, _ := json.Marshal(decoded)
 		fmt.Println(string(jsonOutput))
 	case "info":
-		data, err := os.ReadFile(os.Args[2])
+		data, err := os.ReadFile(args[1])
 		if err != nil {
 			fmt.Printf("error: read file: %v\n", err)
 			os.Exit(1)
@@ -245,6 +270,14 @@ func main() {
 		fmt.Printf("Length: %v\n", parsedTorrentFile.info.length)
 		fmt.Printf("Info Hash: %v\n", parsedTorrentFile.infoHash)
 		fmt.Printf("Piece Length: %v\n", parsedTorrentFile.info.pieceLength)
+
+		if parsedTorrentFile.info.isMultiFile() {
+			fmt.Println("Files:")
+			for _, file := range parsedTorrentFile.info.files {
+				fmt.Printf("%v (%v bytes)\n", filepath.Join(file.path...), file.length)
+			}
+		}
+
 		fmt.Println("Piece Hashes:")
 		pieces := parsedTorrentFile.info.pieces
 		if err != nil {
@@ -255,7 +288,7 @@ func main() {
 			fmt.Printf("%v\n", piece)
 		}
 	case "peers":
-		data, err := os.ReadFile(os.Args[2])
+		data, err := os.ReadFile(args[1])
 		if err != nil {
 			fmt.Printf("error: read file: %v\n", err)
 			os.Exit(1)
@@ -288,7 +321,7 @@ func main() {
 			fmt.Printf("%v:%v\n", peer.IP, peer.Port)
 		}
 	case "handshake":
-		data, err := os.ReadFile(os.Args[2])
+		data, err := os.ReadFile(args[1])
 		if err != nil {
 			fmt.Printf("error: read file: %v\n", err)
 			os.Exit(1)
@@ -311,7 +344,7 @@ func main() {
 			PeerId:   "00112233445566778899",
 		}
 
-		peerAddress := os.Args[3]
+		peerAddress := args[2]
 		conn, err := net.Dial("tcp", peerAddress)
 		if err != nil {
 			panic(err)
@@ -325,11 +358,11 @@ func main() {
 
 	case "download_piece":
 		var torrentFile, outputPath string
-		if os.Args[2] == "-o" {
-			torrentFile = os.Args[4]
-			outputPath = os.Args[3]
+		if args[1] == "-o" {
+			torrentFile = args[3]
+			outputPath = args[2]
 		} else {
-			torrentFile = os.Args[2]
+			torrentFile = args[1]
 			outputPath = "."
 		}
 
@@ -379,7 +412,7 @@ func main() {
 
 		_ = performHandshake(conn, handshakeMessage.getBytes())
 
-		pieceIndex, _ := strconv.Atoi(os.Args[5])
+		pieceIndex, _ := strconv.Atoi(args[4])
 		downloadedPiece := downloadPiece(conn, parsedTorrentFile, pieceIndex)
 
 		file, err := os.Create(outputPath)
@@ -397,11 +430,11 @@ func main() {
 		fmt.Printf("Piece downloaded to %s.\n", outputPath)
 	case "download":
 		var torrentFile, outputPath string
-		if os.Args[2] == "-o" {
-			torrentFile = os.Args[4]
-			outputPath = os.Args[3]
+		if args[1] == "-o" {
+			torrentFile = args[3]
+			outputPath = args[2]
 		} else {
-			torrentFile = os.Args[2]
+			torrentFile = args[1]
 			outputPath = "."
 		}
 
@@ -441,36 +474,282 @@ func main() {
 
 		peers := performPeerDiscovery(finalUrl)
 
-		peerAddress := fmt.Sprintf("%s:%d", peers[1].IP.String(), peers[1].Port)
+		storage, err := newStorage(storageKind, parsedTorrentFile.info, outputPath)
+		if err != nil {
+			panic(err)
+		}
+
+		defer storage.Close()
 
-		file, err := os.Create(outputPath)
+		state := loadDownloadState(stateFilePath(outputPath), parsedTorrentFile.infoHash, len(parsedTorrentFile.info.pieces))
+		if err := verifyResumeState(storage, parsedTorrentFile, state); err != nil {
+			panic(err)
+		}
+
+		var peerConns []*PeerConn
+		for _, peer := range peers {
+			peerConn, err := dialPeerConn(peer, handshakeMessage)
+			if err != nil {
+				fmt.Printf("skipping peer %s: %v\n", peer.IP, err)
+				continue
+			}
+
+			defer peerConn.Close()
+			peerConns = append(peerConns, peerConn)
+		}
+
+		if len(peerConns) == 0 {
+			panic(fmt.Errorf("no usable peers"))
+		}
+
+		scheduler := NewPieceScheduler(parsedTorrentFile, storage, peerConns)
+		scheduler.state = state
+		if err := scheduler.Run(); err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Downloaded %s to %s.\n", torrentFile, outputPath)
+
+	case "magnet_handshake":
+		magnetLink, err := parseMagnetLink(args[1])
 		if err != nil {
 			panic(err)
 		}
 
-		defer file.Close()
+		if len(magnetLink.trackers) == 0 {
+			panic(fmt.Errorf("magnet link has no trackers"))
+		}
 
-		numPieces := len(parsedTorrentFile.info.pieces)
-		for pieceIndex := 0; pieceIndex < numPieces; pieceIndex++ {
-			fmt.Printf("Downloading piece %d\n", pieceIndex)
+		hexDecodedHash, err := hex.DecodeString(magnetLink.infoHash)
+		if err != nil {
+			panic(err)
+		}
 
-			fmt.Println("Performing handshake")
-			conn, err := net.Dial("tcp", peerAddress)
+		finalUrl := getPeerDiscoveryUrl(
+			string(hexDecodedHash),
+			"00112233445566778899",
+			"6881",
+			"0",
+			"0",
+			999, // total length is unknown until the info dict is fetched
+			"1",
+			magnetLink.trackers[0],
+		)
+
+		peers := performPeerDiscovery(finalUrl)
+		if len(peers) == 0 {
+			panic(fmt.Errorf("no peers returned by tracker"))
+		}
+
+		peerAddress := fmt.Sprintf("%s:%d", peers[0].IP.String(), peers[0].Port)
+		conn, err := net.Dial("tcp", peerAddress)
+		if err != nil {
+			panic(err)
+		}
+
+		defer conn.Close()
+
+		handshakeMessage := HandshakeMessage{
+			Length:        19,
+			Protocol:      "BitTorrent protocol",
+			ReservedBytes: extensionReservedBytes(),
+			InfoHash:      string(hexDecodedHash),
+			PeerId:        "00112233445566778899",
+		}
+
+		handshakeResponse := performHandshake(conn, handshakeMessage.getBytes())
+		fmt.Printf("Peer ID: %s\n", handshakeResponse.PeerId)
+
+		if supportsExtensions(handshakeResponse.ReservedBytes) {
+			if err := sendExtendedHandshake(conn); err != nil {
+				panic(err)
+			}
+
+			peerUtMetadataId, _, err := readExtendedHandshake(conn)
 			if err != nil {
 				panic(err)
 			}
 
-			_ = performHandshake(conn, handshakeMessage.getBytes())
+			fmt.Printf("Peer Metadata Extension ID: %d\n", peerUtMetadataId)
+		}
+
+	case "magnet_info":
+		parsedTorrentFile, err := fetchTorrentFromMagnet(args[1])
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Tracker URL: %v\n", parsedTorrentFile.trackerUrl)
+		fmt.Printf("Length: %v\n", parsedTorrentFile.info.length)
+		fmt.Printf("Info Hash: %v\n", parsedTorrentFile.infoHash)
+		fmt.Printf("Piece Length: %v\n", parsedTorrentFile.info.pieceLength)
+		fmt.Println("Piece Hashes:")
+		for _, piece := range parsedTorrentFile.info.pieces {
+			fmt.Printf("%v\n", piece)
+		}
+
+	case "magnet_download_piece":
+		var magnetUri, outputPath string
+		if args[1] == "-o" {
+			outputPath = args[2]
+			magnetUri = args[3]
+		} else {
+			magnetUri = args[1]
+			outputPath = "."
+		}
+
+		parsedTorrentFile, err := fetchTorrentFromMagnet(magnetUri)
+		if err != nil {
+			panic(err)
+		}
+
+		hexDecodedHash, err := hex.DecodeString(parsedTorrentFile.infoHash)
+		if err != nil {
+			panic(err)
+		}
+
+		finalUrl := getPeerDiscoveryUrl(
+			string(hexDecodedHash),
+			"00112233445566778899",
+			"6881",
+			"0",
+			"0",
+			parsedTorrentFile.info.length,
+			"1",
+			parsedTorrentFile.trackerUrl,
+		)
+
+		peers := performPeerDiscovery(finalUrl)
+		if len(peers) == 0 {
+			panic(fmt.Errorf("no peers returned by tracker"))
+		}
+
+		peerAddress := fmt.Sprintf("%s:%d", peers[0].IP.String(), peers[0].Port)
+		conn, err := net.Dial("tcp", peerAddress)
+		if err != nil {
+			panic(err)
+		}
+
+		defer conn.Close()
+
+		handshakeMessage := HandshakeMessage{
+			Length:   19,
+			Protocol: "BitTorrent protocol",
+			InfoHash: string(hexDecodedHash),
+			PeerId:   "00112233445566778899",
+		}
+
+		_ = performHandshake(conn, handshakeMessage.getBytes())
+
+		pieceIndex, _ := strconv.Atoi(args[4])
+		downloadedPiece := downloadPiece(conn, parsedTorrentFile, pieceIndex)
+
+		file, err := os.Create(outputPath)
+		if err != nil {
+			panic(err)
+		}
+
+		defer file.Close()
+
+		if _, err := file.Write(downloadedPiece); err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Piece downloaded to %s.\n", outputPath)
+
+	case "magnet_download":
+		var magnetUri, outputPath string
+		if args[1] == "-o" {
+			outputPath = args[2]
+			magnetUri = args[3]
+		} else {
+			magnetUri = args[1]
+			outputPath = "."
+		}
+
+		parsedTorrentFile, err := fetchTorrentFromMagnet(magnetUri)
+		if err != nil {
+			panic(err)
+		}
+
+		hexDecodedHash, err := hex.DecodeString(parsedTorrentFile.infoHash)
+		if err != nil {
+			panic(err)
+		}
+
+		handshakeMessage := HandshakeMessage{
+			Length:   19,
+			Protocol: "BitTorrent protocol",
+			InfoHash: string(hexDecodedHash),
+			PeerId:   "00112233445566778899",
+		}
+
+		finalUrl := getPeerDiscoveryUrl(
+			string(hexDecodedHash),
+			"00112233445566778899",
+			"6881",
+			"0",
+			"0",
+			parsedTorrentFile.info.length,
+			"1",
+			parsedTorrentFile.trackerUrl,
+		)
+
+		peers := performPeerDiscovery(finalUrl)
+
+		storage, err := newStorage(storageKind, parsedTorrentFile.info, outputPath)
+		if err != nil {
+			panic(err)
+		}
+
+		defer storage.Close()
 
-			downloadedPiece := downloadPiece(conn, parsedTorrentFile, pieceIndex)
-			_, err = file.Write(downloadedPiece)
+		state := loadDownloadState(stateFilePath(outputPath), parsedTorrentFile.infoHash, len(parsedTorrentFile.info.pieces))
+		if err := verifyResumeState(storage, parsedTorrentFile, state); err != nil {
+			panic(err)
+		}
+
+		var peerConns []*PeerConn
+		for _, peer := range peers {
+			peerConn, err := dialPeerConn(peer, handshakeMessage)
 			if err != nil {
+				fmt.Printf("skipping peer %s: %v\n", peer.IP, err)
+				continue
+			}
+
+			defer peerConn.Close()
+			peerConns = append(peerConns, peerConn)
+		}
+
+		if len(peerConns) == 0 {
+			panic(fmt.Errorf("no usable peers"))
+		}
+
+		scheduler := NewPieceScheduler(parsedTorrentFile, storage, peerConns)
+		scheduler.state = state
+		if err := scheduler.Run(); err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Downloaded %s to %s.\n", magnetUri, outputPath)
+
+	case "serve":
+		if len(args) < 3 {
+			panic(fmt.Errorf("usage: serve <port> <torrent-file>..."))
+		}
+
+		port := args[1]
+		server := NewSeedServer("00112233445566778899")
+
+		for _, torrentFile := range args[2:] {
+			outputPath := outputPathForTorrent(torrentFile)
+			if err := server.AddTorrent(torrentFile, outputPath, storageKind); err != nil {
 				panic(err)
 			}
+		}
 
-			fmt.Printf("Piece downloaded to %s.\n", outputPath)
-			fmt.Println("Closing connection.")
-			conn.Close()
+		if err := server.ListenAndServe(port); err != nil {
+			panic(err)
 		}
 
 	default:
@@ -479,6 +758,96 @@ func main() {
 	}
 }
 
+// fileSpan maps a range [start, end) of the torrent's global byte space to
+// the on-disk file that holds it, so downloaded pieces can be written to the
+// right file even when they straddle a file boundary in multi-file mode.
+type fileSpan struct {
+	file  *os.File
+	start int64
+	end   int64
+}
+
+// openOutputFiles opens (without truncating) the on-disk layout for a
+// torrent: a single file at outputPath for single-file torrents, or
+// outputPath/<name>/<path...> for each file in a multi-file torrent. Any
+// data already at outputPath is left intact so verifyResumeState can
+// re-hash it before the scheduler overwrites anything.
+func openOutputFiles(info TorrentInfo, outputPath string) ([]fileSpan, error) {
+	if !info.isMultiFile() {
+		file, err := os.OpenFile(outputPath, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		return []fileSpan{{file: file, start: 0, end: int64(info.length)}}, nil
+	}
+
+	root := filepath.Join(outputPath, info.name)
+
+	var spans []fileSpan
+	var offset int64
+	for _, torrentFile := range info.files {
+		fullPath := filepath.Join(append([]string{root}, torrentFile.path...)...)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+			return nil, err
+		}
+
+		file, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		spans = append(spans, fileSpan{file: file, start: offset, end: offset + int64(torrentFile.length)})
+		offset += int64(torrentFile.length)
+	}
+
+	return spans, nil
+}
+
+func closeOutputFiles(spans []fileSpan) {
+	for _, span := range spans {
+		span.file.Close()
+	}
+}
+
+// writePieceAcrossFiles writes data, starting at pieceGlobalOffset in the
+// torrent's global byte space, splitting it across file spans as needed.
+func writePieceAcrossFiles(spans []fileSpan, pieceGlobalOffset int64, data []byte) error {
+	remaining := data
+	pos := pieceGlobalOffset
+
+	for len(remaining) > 0 {
+		span, err := spanAt(spans, pos)
+		if err != nil {
+			return err
+		}
+
+		writeLen := int64(len(remaining))
+		if maxLen := span.end - pos; writeLen > maxLen {
+			writeLen = maxLen
+		}
+
+		if _, err := span.file.WriteAt(remaining[:writeLen], pos-span.start); err != nil {
+			return err
+		}
+
+		pos += writeLen
+		remaining = remaining[writeLen:]
+	}
+
+	return nil
+}
+
+func spanAt(spans []fileSpan, offset int64) (fileSpan, error) {
+	for _, span := range spans {
+		if offset >= span.start && offset < span.end {
+			return span, nil
+		}
+	}
+
+	return fileSpan{}, fmt.Errorf("offset %d outside of torrent file spans", offset)
+}
+
 func downloadPiece(conn net.Conn, parsedTorrentFile ParsedTorrentFile, index int) []byte {
 	// wait for bitfield message (id = 5)
 	peerMessage := PeerMessage{}
@@ -539,7 +908,7 @@ func downloadPiece(conn net.Conn, parsedTorrentFile ParsedTorrentFile, index int
 
 	pieceCnt := int(math.Ceil(float64(fileLength) / float64(pieceLength)))
 	if index == pieceCnt-1 {
-		pieceLength = fileLength % pieceLength
+		pieceLength = fileLength - (pieceCnt-1)*parsedTorrentFile.info.pieceLength
 	}
 
 	blockCnt := int(math.Ceil(float64(pieceLength) / float64(BLOCK_SIZE)))
@@ -631,11 +1000,15 @@ func performHandshake(
 	}
 
 	protocolLength := int(buff[0])
+	var reservedBytes [8]byte
+	copy(reservedBytes[:], buff[1+protocolLength:1+protocolLength+8])
+
 	handShakeResponse := HandshakeMessage{
-		Length:   protocolLength,
-		Protocol: string(buff[1 : 1+protocolLength]),
-		InfoHash: fmt.Sprintf("%x", buff[1+protocolLength:48]),
-		PeerId:   fmt.Sprintf("%x", buff[48:68]),
+		Length:        protocolLength,
+		Protocol:      string(buff[1 : 1+protocolLength]),
+		ReservedBytes: reservedBytes,
+		InfoHash:      fmt.Sprintf("%x", buff[1+protocolLength:48]),
+		PeerId:        fmt.Sprintf("%x", buff[48:68]),
 	}
 
 	return handShakeResponse
@@ -645,7 +1018,7 @@ func (h *HandshakeMessage) getBytes() []byte {
 	handshakeMessage := []byte{}
 	handshakeMessage = append(handshakeMessage, byte(h.Length))
 	handshakeMessage = append(handshakeMessage, []byte(h.Protocol)...)
-	handshakeMessage = append(handshakeMessage, make([]byte, 8)...)
+	handshakeMessage = append(handshakeMessage, h.ReservedBytes[:]...)
 	handshakeMessage = append(handshakeMessage, h.InfoHash...)
 	handshakeMessage = append(handshakeMessage, []byte(h.PeerId)...)
 
@@ -653,36 +1026,56 @@ func (h *HandshakeMessage) getBytes() []byte {
 }
 
 func performPeerDiscovery(finalUrl string) []Peer {
-	res, err := http.Get(finalUrl)
+	parsedUrl, err := url.Parse(finalUrl)
 	if err != nil {
 		panic(err)
 	}
 
+	if parsedUrl.Scheme == "udp" {
+		return performUdpPeerDiscovery(parsedUrl)
+	}
+
+	trackerResponse, err := announceHTTP(finalUrl)
+	if err != nil {
+		panic(err)
+	}
+
+	peers, err := parsePeers(trackerResponse.Peers)
+	if err != nil {
+		panic(err)
+	}
+
+	return peers
+}
+
+// announceHTTP sends a single GET announce to an HTTP tracker and decodes
+// its bencoded response. Unlike performPeerDiscovery it returns the whole
+// TrackerResponse (not just the peer list), since the serve command also
+// needs the re-announce interval.
+func announceHTTP(finalUrl string) (TrackerResponse, error) {
+	res, err := http.Get(finalUrl)
+	if err != nil {
+		return TrackerResponse{}, err
+	}
+
 	defer res.Body.Close()
 	resBytes, err := io.ReadAll(res.Body)
 	if err != nil {
-		panic(err)
+		return TrackerResponse{}, err
 	}
 
 	m, _, err := decodeDict(string(resBytes), 0)
 	if err != nil {
-		panic(err)
+		return TrackerResponse{}, err
 	}
 
-	trackerResponse := TrackerResponse{
+	return TrackerResponse{
 		Complete:    m["complete"].(int),
 		Incomplete:  m["incomplete"].(int),
 		Interval:    m["interval"].(int),
 		MinInterval: m["min interval"].(int),
 		Peers:       m["peers"].(string),
-	}
-
-	peers, err := parsePeers(trackerResponse.Peers)
-	if err != nil {
-		panic(err)
-	}
-
-	return peers
+	}, nil
 }
 
 func getPeerDiscoveryUrl(
@@ -735,6 +1128,16 @@ func parseTorrentFile(data []byte) (ParsedTorrentFile, error) {
 		return ParsedTorrentFile{}, fmt.Errorf("no info section")
 	}
 
+	trackerUrl, _ := decoded["announce"].(string)
+
+	return parsedTorrentFromInfoDict(trackerUrl, info)
+}
+
+// parsedTorrentFromInfoDict builds a ParsedTorrentFile from an already
+// decoded info dict and the tracker URL it should be announced to. This is
+// shared by parseTorrentFile (info dict read from a .torrent file) and the
+// magnet link flow (info dict fetched from a peer via ut_metadata).
+func parsedTorrentFromInfoDict(trackerUrl string, info map[string]interface{}) (ParsedTorrentFile, error) {
 	h := sha1.New()
 	if err := bencode.Marshal(h, info); err != nil {
 		panic(err)
@@ -745,19 +1148,69 @@ func parseTorrentFile(data []byte) (ParsedTorrentFile, error) {
 		panic(err)
 	}
 
+	torrentInfo := TorrentInfo{
+		name:        fmt.Sprintf("%v", info["name"]),
+		pieceLength: info["piece length"].(int),
+		pieces:      pieces,
+	}
+
+	if rawFiles, ok := info["files"].([]interface{}); ok {
+		files, length, err := getFiles(rawFiles)
+		if err != nil {
+			return ParsedTorrentFile{}, err
+		}
+
+		torrentInfo.files = files
+		torrentInfo.length = length
+	} else {
+		torrentInfo.length = info["length"].(int)
+	}
+
 	parsedTorrent := ParsedTorrentFile{
-		trackerUrl: decoded["announce"].(string),
+		trackerUrl: trackerUrl,
 		infoHash:   fmt.Sprintf("%x", h.Sum(nil)),
-		info: TorrentInfo{
-			length:      info["length"].(int),
-			pieceLength: info["piece length"].(int),
-			pieces:      pieces,
-		},
+		info:       torrentInfo,
 	}
 
 	return parsedTorrent, nil
 }
 
+// getFiles parses the info dict's "files" list (multi-file mode) into
+// TorrentFileInfo entries and returns the combined length of all files.
+func getFiles(rawFiles []interface{}) (files []TorrentFileInfo, totalLength int, err error) {
+	for _, rawFile := range rawFiles {
+		fileDict, ok := rawFile.(map[string]interface{})
+		if !ok {
+			return nil, 0, fmt.Errorf("file entry is not a dict")
+		}
+
+		length, ok := fileDict["length"].(int)
+		if !ok {
+			return nil, 0, fmt.Errorf("file entry missing length")
+		}
+
+		rawPath, ok := fileDict["path"].([]interface{})
+		if !ok {
+			return nil, 0, fmt.Errorf("file entry missing path")
+		}
+
+		path := make([]string, 0, len(rawPath))
+		for _, component := range rawPath {
+			pathComponent, ok := component.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("file path component is not a string")
+			}
+
+			path = append(path, pathComponent)
+		}
+
+		files = append(files, TorrentFileInfo{length: length, path: path})
+		totalLength += length
+	}
+
+	return files, totalLength, nil
+}
+
 func getPieces(pieceI interface{}) (pieces []string, err error) {
 	pieceHash, ok := pieceI.(string)
 	if !ok {
@@ -0,0 +1,80 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// mmapStorage memory-maps the whole output file so piece writes are plain
+// memory copies instead of syscalls - worthwhile for large, single-file
+// torrents. It only supports single-file torrents: a multi-file torrent
+// would need one mapping per file, which isn't worth it for this client.
+type mmapStorage struct {
+	file *os.File
+	data []byte
+}
+
+func newMmapStorage(info TorrentInfo, outputPath string) (Storage, error) {
+	if info.isMultiFile() {
+		return nil, fmt.Errorf("mmap storage only supports single-file torrents")
+	}
+
+	file, err := os.OpenFile(outputPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if stat.Size() < int64(info.length) {
+		if err := file.Truncate(int64(info.length)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, info.length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &mmapStorage{file: file, data: data}, nil
+}
+
+func (s *mmapStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(s.data)) {
+		return 0, fmt.Errorf("write at %d exceeds mapped region of %d bytes", off, len(s.data))
+	}
+
+	return copy(s.data[off:], p), nil
+}
+
+func (s *mmapStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+
+	return copy(p, s.data[off:]), nil
+}
+
+func (s *mmapStorage) PieceCompleted(index int) error {
+	return nil
+}
+
+func (s *mmapStorage) Close() error {
+	if err := syscall.Munmap(s.data); err != nil {
+		s.file.Close()
+		return err
+	}
+
+	return s.file.Close()
+}
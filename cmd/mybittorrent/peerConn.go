@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+)
+
+// PeerConn wraps a single persistent TCP connection to a peer: its
+// handshake state and the bitfield of pieces it has available. A PeerConn
+// is only returned once the peer has unchoked us, so it is immediately
+// ready to serve piece requests.
+type PeerConn struct {
+	conn     net.Conn
+	peer     Peer
+	peerId   string
+	bitfield []byte
+}
+
+// dialPeerConn connects to a peer, performs the BitTorrent handshake, reads
+// its bitfield, and sends interested, waiting for the peer to unchoke us.
+func dialPeerConn(peer Peer, handshakeMessage HandshakeMessage) (*PeerConn, error) {
+	peerAddress := fmt.Sprintf("%s:%d", peer.IP.String(), peer.Port)
+	conn, err := net.Dial("tcp", peerAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	handshakeResponse := performHandshake(conn, handshakeMessage.getBytes())
+
+	bitfield, err := readBitfield(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 1, INTERESTED_MESSAGE_ID}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := waitForUnchoke(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &PeerConn{conn: conn, peer: peer, peerId: handshakeResponse.PeerId, bitfield: bitfield}, nil
+}
+
+func (pc *PeerConn) Close() error {
+	return pc.conn.Close()
+}
+
+// hasPiece reports whether this peer's bitfield marks the given piece as
+// available.
+func (pc *PeerConn) hasPiece(index int) bool {
+	byteIndex := index / 8
+	if byteIndex >= len(pc.bitfield) {
+		return false
+	}
+
+	bitIndex := uint(7 - index%8)
+	return pc.bitfield[byteIndex]&(1<<bitIndex) != 0
+}
+
+// downloadPiece requests and assembles a single piece over this peer's
+// connection, verifying its SHA-1 hash against the torrent's piece table.
+// Unlike the top-level downloadPiece used by the single-peer commands, it
+// returns errors instead of panicking so the scheduler can retry on a
+// different peer.
+func (pc *PeerConn) downloadPiece(torrent ParsedTorrentFile, index int) ([]byte, error) {
+	fileLength := torrent.info.length
+	pieceLength := torrent.info.pieceLength
+
+	pieceCnt := int(math.Ceil(float64(fileLength) / float64(pieceLength)))
+	if index == pieceCnt-1 {
+		pieceLength = fileLength - (pieceCnt-1)*torrent.info.pieceLength
+	}
+
+	blockCnt := int(math.Ceil(float64(pieceLength) / float64(BLOCK_SIZE)))
+
+	data := []byte{}
+	for i := 0; i < blockCnt; i++ {
+		blockLength := BLOCK_SIZE
+		if i == blockCnt-1 {
+			blockLength = pieceLength - ((blockCnt - 1) * BLOCK_SIZE)
+		}
+
+		peerMessage := PeerMessage{
+			messageLength: 13,
+			messageId:     REQUEST_MESSAGE_ID,
+			payload: PeerMessagePayload{
+				index:  uint32(index),
+				offset: uint32(i * BLOCK_SIZE),
+				length: uint32(blockLength),
+			},
+		}
+
+		var buff bytes.Buffer
+		binary.Write(&buff, binary.BigEndian, peerMessage)
+
+		if _, err := pc.conn.Write(buff.Bytes()); err != nil {
+			return nil, err
+		}
+
+		block, err := readPieceBlock(pc.conn)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, block...)
+	}
+
+	downloadedDataHash := fmt.Sprintf("%x", sha1.Sum(data))
+	if downloadedDataHash != torrent.info.pieces[index] {
+		return nil, fmt.Errorf("piece %d: hash mismatch", index)
+	}
+
+	return data, nil
+}
+
+func readBitfield(conn net.Conn) ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBytes)
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+
+	if payload[0] != BIT_FIELD_MESSAGE_ID {
+		return nil, fmt.Errorf("expected bitfield message, got id %d", payload[0])
+	}
+
+	return payload[1:], nil
+}
+
+func waitForUnchoke(conn net.Conn) error {
+	for {
+		lengthBytes := make([]byte, 4)
+		if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+			return err
+		}
+
+		length := binary.BigEndian.Uint32(lengthBytes)
+		if length == 0 {
+			continue // keep-alive
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return err
+		}
+
+		if payload[0] == UNCHOKE_MESSAGE_ID {
+			return nil
+		}
+	}
+}
+
+func readPieceBlock(conn net.Conn) ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBytes)
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+
+	if payload[0] != PIECE_MESSAGE_ID {
+		return nil, fmt.Errorf("expected piece message, got id %d", payload[0])
+	}
+
+	return payload[9:], nil
+}
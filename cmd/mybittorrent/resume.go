@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// DownloadState is the persisted record of which pieces of a download have
+// already completed: the info hash it belongs to (so a state file is never
+// applied to the wrong torrent) and a bitfield of completed pieces, in the
+// same most-significant-bit-first layout as a peer wire bitfield.
+type DownloadState struct {
+	path      string
+	infoHash  string
+	numPieces int
+	bitfield  []byte
+}
+
+func stateFilePath(outputPath string) string {
+	return outputPath + ".state"
+}
+
+// loadDownloadState reads the state file at path if it exists and its
+// recorded info hash matches infoHash. Otherwise - no file, unreadable
+// file, or a hash belonging to a different torrent - it returns a fresh,
+// all-incomplete state so the download starts from scratch.
+func loadDownloadState(path string, infoHash string, numPieces int) *DownloadState {
+	bitfieldLength := (numPieces + 7) / 8
+
+	state := &DownloadState{
+		path:      path,
+		infoHash:  infoHash,
+		numPieces: numPieces,
+		bitfield:  make([]byte, bitfieldLength),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state
+	}
+
+	if len(data) < 20 {
+		return state
+	}
+
+	storedInfoHash := hex.EncodeToString(data[:20])
+	if storedInfoHash != infoHash {
+		return state
+	}
+
+	storedBitfield := data[20:]
+	copy(state.bitfield, storedBitfield)
+
+	return state
+}
+
+func (s *DownloadState) hasPiece(index int) bool {
+	byteIndex := index / 8
+	if byteIndex >= len(s.bitfield) {
+		return false
+	}
+
+	bitIndex := uint(7 - index%8)
+	return s.bitfield[byteIndex]&(1<<bitIndex) != 0
+}
+
+func (s *DownloadState) markPieceComplete(index int) {
+	byteIndex := index / 8
+	bitIndex := uint(7 - index%8)
+	s.bitfield[byteIndex] |= 1 << bitIndex
+}
+
+func (s *DownloadState) clearPiece(index int) {
+	byteIndex := index / 8
+	bitIndex := uint(7 - index%8)
+	s.bitfield[byteIndex] &^= 1 << bitIndex
+}
+
+// save atomically updates the state file: it writes to a temp file and
+// renames it over the real path, so a crash mid-write never leaves a
+// corrupt state file behind.
+func (s *DownloadState) save() error {
+	hexDecodedHash, err := hex.DecodeString(s.infoHash)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(hexDecodedHash)
+	buf.Write(s.bitfield)
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
+
+// bitfieldMessage builds the wire-format bitfield message (length prefix +
+// message id 5 + payload) for the pieces recorded as complete in this
+// state; SeedServer sends it to each inbound peer after the handshake.
+func (s *DownloadState) bitfieldMessage() []byte {
+	message := append([]byte{BIT_FIELD_MESSAGE_ID}, s.bitfield...)
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(message)))
+
+	return append(length, message...)
+}
+
+// verifyResumeState re-hashes every piece the state file claims is already
+// complete against the torrent's piece table, clearing any that no longer
+// match (truncated or corrupted output) so they get redownloaded.
+func verifyResumeState(storage Storage, torrent ParsedTorrentFile, state *DownloadState) error {
+	pieceLength := torrent.info.pieceLength
+	numPieces := len(torrent.info.pieces)
+
+	for index := 0; index < numPieces; index++ {
+		if !state.hasPiece(index) {
+			continue
+		}
+
+		length := pieceLength
+		if index == numPieces-1 {
+			length = torrent.info.length - pieceLength*(numPieces-1)
+		}
+
+		data := make([]byte, length)
+		if _, err := storage.ReadAt(data, int64(index)*int64(pieceLength)); err != nil {
+			state.clearPiece(index)
+			continue
+		}
+
+		if fmt.Sprintf("%x", sha1.Sum(data)) != torrent.info.pieces[index] {
+			state.clearPiece(index)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PieceScheduler coordinates concurrent piece downloads across a pool of
+// peer connections. Work is handed out from a shared queue in rarest-first
+// order (the least-replicated pieces go first), and failed pieces - from a
+// bad hash or a dropped connection - are put back on the queue for another
+// peer to retry.
+type PieceScheduler struct {
+	torrent ParsedTorrentFile
+	storage Storage
+	peers   []*PeerConn
+
+	// state is optional: when set, pieces it already marks complete are
+	// skipped, and it is updated and saved after every piece this run
+	// downloads, so an interrupted download can resume later.
+	state *DownloadState
+}
+
+func NewPieceScheduler(torrent ParsedTorrentFile, storage Storage, peers []*PeerConn) *PieceScheduler {
+	return &PieceScheduler{torrent: torrent, storage: storage, peers: peers}
+}
+
+// Run downloads every piece of the torrent not already marked complete in
+// s.state (all of them, if s.state is nil) and writes each one to the
+// correct file offset as soon as it is verified, so pieces completing out
+// of order is safe. It blocks until every pending piece has been
+// downloaded.
+func (s *PieceScheduler) Run() error {
+	numPieces := len(s.torrent.info.pieces)
+	pieceLength := s.torrent.info.pieceLength
+
+	var pending []int
+	for index := 0; index < numPieces; index++ {
+		if s.state == nil || !s.state.hasPiece(index) {
+			pending = append(pending, index)
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	counts := pieceAvailability(s.peers, pending)
+	for _, index := range pending {
+		if counts[index] == 0 {
+			return fmt.Errorf("no connected peer has piece %d", index)
+		}
+	}
+
+	order := rarestFirstOrder(pending, counts)
+	work := make(chan int, numPieces*(len(s.peers)+1))
+	for _, index := range order {
+		work <- index
+	}
+
+	var (
+		mu        sync.Mutex
+		remaining = len(pending)
+		firstErr  error
+		closeOnce sync.Once
+	)
+	done := make(chan struct{})
+	stop := func() { closeOnce.Do(func() { close(done) }) }
+
+	var wg sync.WaitGroup
+	for _, peerConn := range s.peers {
+		wg.Add(1)
+		go func(pc *PeerConn) {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				case index := <-work:
+					if !pc.hasPiece(index) {
+						work <- index
+						continue
+					}
+
+					data, err := pc.downloadPiece(s.torrent, index)
+					if err != nil {
+						fmt.Printf("peer %s failed piece %d: %v\n", pc.peer.IP, index, err)
+						work <- index
+						continue
+					}
+
+					offset := int64(index) * int64(pieceLength)
+					if _, err := s.storage.WriteAt(data, offset); err != nil {
+						mu.Lock()
+						if firstErr == nil {
+							firstErr = err
+						}
+						mu.Unlock()
+						stop()
+						return
+					}
+
+					if err := s.storage.PieceCompleted(index); err != nil {
+						mu.Lock()
+						if firstErr == nil {
+							firstErr = err
+						}
+						mu.Unlock()
+						stop()
+						return
+					}
+
+					mu.Lock()
+					if s.state != nil {
+						s.state.markPieceComplete(index)
+						if err := s.state.save(); err != nil && firstErr == nil {
+							firstErr = err
+						}
+					}
+
+					remaining--
+					finished := remaining == 0
+					mu.Unlock()
+
+					if finished {
+						stop()
+						return
+					}
+				}
+			}
+		}(peerConn)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// pieceAvailability counts, for each of pieceIndices, how many of peers
+// report having that piece.
+func pieceAvailability(peers []*PeerConn, pieceIndices []int) map[int]int {
+	counts := make(map[int]int, len(pieceIndices))
+	for _, pc := range peers {
+		for _, index := range pieceIndices {
+			if pc.hasPiece(index) {
+				counts[index]++
+			}
+		}
+	}
+	return counts
+}
+
+// rarestFirstOrder reorders pieceIndices by counts, least-replicated first.
+func rarestFirstOrder(pieceIndices []int, counts map[int]int) []int {
+	order := make([]int, len(pieceIndices))
+	copy(order, pieceIndices)
+
+	sort.Slice(order, func(a, b int) bool {
+		return counts[order[a]] < counts[order[b]]
+	})
+
+	return order
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	seedMaxUnchoked             = 4
+	seedUnchokeRotateInterval   = 10 * time.Second
+	seedOptimisticUnchokeEvery  = 30 * time.Second
+	seedDefaultAnnounceInterval = 30 * time.Minute
+)
+
+// seedTorrent is one torrent the server is willing to serve: its metadata,
+// the storage backend holding its data, and the bitfield of which pieces
+// are actually present.
+type seedTorrent struct {
+	torrent ParsedTorrentFile
+	storage Storage
+	state   *DownloadState
+}
+
+// seedPeer is one inbound peer connection being served. interested is
+// written from servePeer's goroutine and read from the choke loop's
+// goroutine, and choked the other way round, so every access goes through
+// mu.
+type seedPeer struct {
+	conn    net.Conn
+	torrent *seedTorrent
+
+	mu         sync.Mutex
+	interested bool
+	choked     bool
+}
+
+func (p *seedPeer) setInterested(interested bool) {
+	p.mu.Lock()
+	p.interested = interested
+	p.mu.Unlock()
+}
+
+func (p *seedPeer) isInterested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.interested
+}
+
+func (p *seedPeer) isChoked() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.choked
+}
+
+// setChokedFlag sets choked and reports whether it changed, so the caller
+// only notifies the peer (and the rest of the choke algorithm only acts)
+// on an actual transition.
+func (p *seedPeer) setChokedFlag(choked bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.choked == choked {
+		return false
+	}
+
+	p.choked = choked
+	return true
+}
+
+// SeedServer accepts incoming BitTorrent connections and serves pieces for
+// a set of loaded torrents - the listener side of the client that, until
+// now, could only leech.
+type SeedServer struct {
+	mu             sync.Mutex
+	torrents       map[string]*seedTorrent // keyed by the raw 20-byte info hash
+	peers          []*seedPeer
+	peerId         string
+	rotationOffset int // advances each rotateUnchoked tick so the unchoked window cycles
+}
+
+func NewSeedServer(peerId string) *SeedServer {
+	return &SeedServer{torrents: make(map[string]*seedTorrent), peerId: peerId}
+}
+
+// AddTorrent loads a .torrent file and the storage backend that already
+// holds (or will hold) its data at outputPath, verifying against its
+// resume state file so only pieces actually on disk are advertised.
+func (srv *SeedServer) AddTorrent(torrentFile string, outputPath string, storageKind string) error {
+	data, err := os.ReadFile(torrentFile)
+	if err != nil {
+		return err
+	}
+
+	parsedTorrentFile, err := parseTorrentFile(data)
+	if err != nil {
+		return err
+	}
+
+	storage, err := newStorage(storageKind, parsedTorrentFile.info, outputPath)
+	if err != nil {
+		return err
+	}
+
+	state := loadDownloadState(stateFilePath(outputPath), parsedTorrentFile.infoHash, len(parsedTorrentFile.info.pieces))
+	if err := verifyResumeState(storage, parsedTorrentFile, state); err != nil {
+		return err
+	}
+
+	hexDecodedHash, err := hex.DecodeString(parsedTorrentFile.infoHash)
+	if err != nil {
+		return err
+	}
+
+	st := &seedTorrent{torrent: parsedTorrentFile, storage: storage, state: state}
+
+	srv.mu.Lock()
+	srv.torrents[string(hexDecodedHash)] = st
+	srv.mu.Unlock()
+
+	go srv.announceLoop(st)
+
+	return nil
+}
+
+// ListenAndServe binds port, runs the choking algorithm in the background,
+// and accepts peers until the process is interrupted (at which point every
+// loaded torrent is announced as "stopped").
+func (srv *SeedServer) ListenAndServe(port string) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		return err
+	}
+
+	defer listener.Close()
+
+	go srv.runChokeLoop()
+	srv.handleShutdown()
+
+	fmt.Printf("Listening for peers on port %s\n", port)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("accept error: %v\n", err)
+			continue
+		}
+
+		go srv.handleConn(conn)
+	}
+}
+
+// handleShutdown announces "stopped" for every loaded torrent when the
+// process receives an interrupt, then exits.
+func (srv *SeedServer) handleShutdown() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+
+	go func() {
+		<-sigCh
+
+		srv.mu.Lock()
+		torrents := make([]*seedTorrent, 0, len(srv.torrents))
+		for _, st := range srv.torrents {
+			torrents = append(torrents, st)
+		}
+		srv.mu.Unlock()
+
+		for _, st := range torrents {
+			if _, err := srv.announce(st, "stopped"); err != nil {
+				fmt.Printf("failed to announce stopped: %v\n", err)
+			}
+		}
+
+		os.Exit(0)
+	}()
+}
+
+func (srv *SeedServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	handshakeBytes := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshakeBytes); err != nil {
+		fmt.Printf("handshake read error: %v\n", err)
+		return
+	}
+
+	protocolLength := int(handshakeBytes[0])
+	reservedEnd := 1 + protocolLength + 8
+	requestedInfoHash := string(handshakeBytes[reservedEnd : reservedEnd+20])
+
+	srv.mu.Lock()
+	torrent, ok := srv.torrents[requestedInfoHash]
+	srv.mu.Unlock()
+
+	if !ok {
+		fmt.Println("rejecting handshake for unknown info hash")
+		return
+	}
+
+	response := HandshakeMessage{
+		Length:   19,
+		Protocol: "BitTorrent protocol",
+		InfoHash: requestedInfoHash,
+		PeerId:   srv.peerId,
+	}
+
+	if _, err := conn.Write(response.getBytes()); err != nil {
+		return
+	}
+
+	peer := &seedPeer{conn: conn, torrent: torrent, choked: true}
+
+	srv.mu.Lock()
+	srv.peers = append(srv.peers, peer)
+	srv.mu.Unlock()
+	defer srv.removePeer(peer)
+
+	if _, err := conn.Write(torrent.state.bitfieldMessage()); err != nil {
+		return
+	}
+
+	srv.servePeer(peer)
+}
+
+// removePeer drops peer from srv.peers once its connection is done, so the
+// choke loop stops writing to it.
+func (srv *SeedServer) removePeer(peer *seedPeer) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for i, p := range srv.peers {
+		if p == peer {
+			srv.peers = append(srv.peers[:i], srv.peers[i+1:]...)
+			return
+		}
+	}
+}
+
+// servePeer honors interested/not-interested and answers request messages
+// with piece messages sourced from the torrent's storage backend, until
+// the peer disconnects.
+func (srv *SeedServer) servePeer(peer *seedPeer) {
+	for {
+		payload, err := readFramedMessage(peer.conn)
+		if err != nil {
+			return
+		}
+
+		if len(payload) == 0 {
+			continue // keep-alive
+		}
+
+		switch payload[0] {
+		case INTERESTED_MESSAGE_ID:
+			peer.setInterested(true)
+		case NOT_INTERESTED_MESSAGE_ID:
+			peer.setInterested(false)
+		case REQUEST_MESSAGE_ID:
+			if peer.isChoked() {
+				continue
+			}
+
+			if err := srv.servePieceRequest(peer, payload); err != nil {
+				fmt.Printf("failed to serve piece request: %v\n", err)
+				return
+			}
+		}
+	}
+}
+
+func (srv *SeedServer) servePieceRequest(peer *seedPeer, payload []byte) error {
+	index := binary.BigEndian.Uint32(payload[1:5])
+	blockOffset := binary.BigEndian.Uint32(payload[5:9])
+	length := binary.BigEndian.Uint32(payload[9:13])
+
+	data := make([]byte, length)
+	pieceOffset := int64(index)*int64(peer.torrent.torrent.info.pieceLength) + int64(blockOffset)
+	if _, err := peer.torrent.storage.ReadAt(data, pieceOffset); err != nil {
+		return err
+	}
+
+	message := make([]byte, 9+len(data))
+	message[0] = PIECE_MESSAGE_ID
+	binary.BigEndian.PutUint32(message[1:5], index)
+	binary.BigEndian.PutUint32(message[5:9], blockOffset)
+	copy(message[9:], data)
+
+	return writeFramedMessage(peer.conn, message)
+}
+
+// runChokeLoop implements a simple choking algorithm: up to
+// seedMaxUnchoked interested peers are unchoked, rotated every
+// seedUnchokeRotateInterval, plus one additional optimistic unchoke every
+// seedOptimisticUnchokeEvery so new peers get a chance to prove useful.
+func (srv *SeedServer) runChokeLoop() {
+	rotateTicker := time.NewTicker(seedUnchokeRotateInterval)
+	optimisticTicker := time.NewTicker(seedOptimisticUnchokeEvery)
+	defer rotateTicker.Stop()
+	defer optimisticTicker.Stop()
+
+	for {
+		select {
+		case <-rotateTicker.C:
+			srv.rotateUnchoked()
+		case <-optimisticTicker.C:
+			srv.optimisticUnchoke()
+		}
+	}
+}
+
+// rotateUnchoked unchokes the next seedMaxUnchoked interested peers,
+// advancing rotationOffset each tick so the window cycles through every
+// interested peer over time instead of always picking the same ones.
+func (srv *SeedServer) rotateUnchoked() {
+	srv.mu.Lock()
+
+	var interested []*seedPeer
+	for _, peer := range srv.peers {
+		if peer.isInterested() {
+			interested = append(interested, peer)
+		}
+	}
+
+	if len(interested) > 0 {
+		offset := srv.rotationOffset % len(interested)
+		rotated := make([]*seedPeer, len(interested))
+		n := copy(rotated, interested[offset:])
+		copy(rotated[n:], interested[:offset])
+		interested = rotated
+
+		srv.rotationOffset += seedMaxUnchoked
+	}
+
+	srv.mu.Unlock()
+
+	// setChoked writes to the peer's socket, so it must run without
+	// holding srv.mu - a slow peer would otherwise stall every caller
+	// that needs the lock (handleConn, removePeer, ...).
+	for i, peer := range interested {
+		srv.setChoked(peer, i >= seedMaxUnchoked)
+	}
+}
+
+func (srv *SeedServer) optimisticUnchoke() {
+	srv.mu.Lock()
+
+	var choked []*seedPeer
+	for _, peer := range srv.peers {
+		if peer.isChoked() {
+			choked = append(choked, peer)
+		}
+	}
+
+	srv.mu.Unlock()
+
+	if len(choked) == 0 {
+		return
+	}
+
+	lucky := choked[int(time.Now().UnixNano())%len(choked)]
+	srv.setChoked(lucky, false)
+}
+
+func (srv *SeedServer) setChoked(peer *seedPeer, choked bool) {
+	if !peer.setChokedFlag(choked) {
+		return
+	}
+
+	messageId := byte(UNCHOKE_MESSAGE_ID)
+	if choked {
+		messageId = CHOKE_MESSAGE_ID
+	}
+
+	if _, err := peer.conn.Write([]byte{0, 0, 0, 1, messageId}); err != nil {
+		fmt.Printf("failed to notify peer of choke state: %v\n", err)
+	}
+}
+
+// announceLoop registers st with its tracker (event=started), then
+// re-announces on the interval the tracker's TrackerResponse returns
+// (falling back to seedDefaultAnnounceInterval if the tracker is
+// unreachable), switching to event=completed once every piece is present.
+func (srv *SeedServer) announceLoop(st *seedTorrent) {
+	interval := seedDefaultAnnounceInterval
+	if resp, err := srv.announce(st, "started"); err != nil {
+		fmt.Printf("tracker announce failed: %v\n", err)
+	} else if resp.Interval > 0 {
+		interval = time.Duration(resp.Interval) * time.Second
+	}
+
+	announcedCompleted := false
+
+	for {
+		time.Sleep(interval)
+
+		if st.torrent.trackerUrl == "" {
+			continue
+		}
+
+		event := ""
+		if !announcedCompleted && srv.bytesLeft(st) == 0 {
+			event = "completed"
+		}
+
+		resp, err := srv.announce(st, event)
+		if err != nil {
+			fmt.Printf("tracker re-announce failed: %v\n", err)
+			continue
+		}
+
+		if event == "completed" {
+			announcedCompleted = true
+		}
+
+		if resp.Interval > 0 {
+			interval = time.Duration(resp.Interval) * time.Second
+		}
+	}
+}
+
+func (srv *SeedServer) announce(st *seedTorrent, event string) (TrackerResponse, error) {
+	hexDecodedHash, err := hex.DecodeString(st.torrent.infoHash)
+	if err != nil {
+		return TrackerResponse{}, err
+	}
+
+	params := url.Values{}
+	params.Add("info_hash", string(hexDecodedHash))
+	params.Add("peer_id", srv.peerId)
+	params.Add("port", "6881")
+	params.Add("uploaded", "0")
+	params.Add("downloaded", "0")
+	params.Add("left", fmt.Sprintf("%d", srv.bytesLeft(st)))
+	params.Add("compact", "1")
+	if event != "" {
+		params.Add("event", event)
+	}
+
+	finalUrl := fmt.Sprintf("%s?%s", st.torrent.trackerUrl, params.Encode())
+
+	return announceHTTP(finalUrl)
+}
+
+func (srv *SeedServer) bytesLeft(st *seedTorrent) int {
+	numPieces := len(st.torrent.info.pieces)
+	completed := 0
+	for index := 0; index < numPieces; index++ {
+		if st.state.hasPiece(index) {
+			completed++
+		}
+	}
+
+	left := st.torrent.info.length - completed*st.torrent.info.pieceLength
+	if left < 0 {
+		left = 0
+	}
+
+	return left
+}
+
+// outputPathForTorrent returns the output path `serve` loads a torrent's
+// data from: torrentFile's base name without its extension (for example
+// "dir/sample.torrent" -> "sample"). Data from an earlier
+// `download`/`magnet_download` is found only if that run was given the
+// same path with -o.
+func outputPathForTorrent(torrentFile string) string {
+	return filepath.Base(torrentFile[:len(torrentFile)-len(filepath.Ext(torrentFile))])
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage is the write/read target a download writes pieces through. Pieces
+// can complete out of order, so every method must be safe to call for any
+// offset without assuming prior pieces have already landed.
+type Storage interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	PieceCompleted(index int) error
+	Close() error
+}
+
+// parseStorageFlag pulls a "-storage=file|mmap|blob" flag out of args,
+// wherever it appears, returning the remaining positional args unchanged.
+// It defaults to "file" when the flag isn't present.
+func parseStorageFlag(args []string) (kind string, rest []string) {
+	kind = "file"
+
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-storage=") {
+			kind = strings.TrimPrefix(arg, "-storage=")
+			continue
+		}
+
+		rest = append(rest, arg)
+	}
+
+	return kind, rest
+}
+
+// newStorage builds the Storage backend named by kind ("file", "mmap" or
+// "blob"), laying out output files for info at outputPath the same way
+// openOutputFiles does.
+func newStorage(kind string, info TorrentInfo, outputPath string) (Storage, error) {
+	switch kind {
+	case "", "file":
+		spans, err := openOutputFiles(info, outputPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &fileStorage{spans: spans}, nil
+	case "mmap":
+		return newMmapStorage(info, outputPath)
+	case "blob":
+		return newBlobStorage(info, outputPath)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", kind)
+	}
+}
+
+// fileStorage is the original single-file-per-torrent-file backend: plain
+// os.File handles written through with WriteAt at the right file and
+// in-file offset.
+type fileStorage struct {
+	spans []fileSpan
+}
+
+func (s *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	if err := writePieceAcrossFiles(s.spans, off, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (s *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	remaining := p
+	pos := off
+	total := 0
+
+	for len(remaining) > 0 {
+		span, err := spanAt(s.spans, pos)
+		if err != nil {
+			return total, err
+		}
+
+		readLen := int64(len(remaining))
+		if maxLen := span.end - pos; readLen > maxLen {
+			readLen = maxLen
+		}
+
+		n, err := span.file.ReadAt(remaining[:readLen], pos-span.start)
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		pos += readLen
+		remaining = remaining[readLen:]
+	}
+
+	return total, nil
+}
+
+func (s *fileStorage) PieceCompleted(index int) error {
+	return nil
+}
+
+func (s *fileStorage) Close() error {
+	closeOutputFiles(s.spans)
+	return nil
+}
+
+// blobStorage stores every verified piece as its own file, named by the
+// piece's SHA-1 hash, in a ".blobs" directory beside outputPath. A blob
+// whose filename matches the hash torrent.info.pieces expects for its
+// index is, by construction, already-verified data, so newBlobStorage
+// rebuilds pieceHash by checking for those files on startup - letting a
+// piece already on disk from a previous run skip re-fetching. Close
+// reassembles every piece it has into the real output layout at
+// outputPath via openOutputFiles, the way fileStorage and mmapStorage
+// leave their data.
+type blobStorage struct {
+	dir         string
+	info        TorrentInfo
+	outputPath  string
+	pieceLength int
+	pieceHash   map[int]string // piece index -> hash, for pieces present on disk
+}
+
+func newBlobStorage(info TorrentInfo, outputPath string) (Storage, error) {
+	dir := outputPath + ".blobs"
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	pieceHash := make(map[int]string, len(info.pieces))
+	for index, hash := range info.pieces {
+		if _, err := os.Stat(filepath.Join(dir, hash+".piece")); err == nil {
+			pieceHash[index] = hash
+		}
+	}
+
+	return &blobStorage{dir: dir, info: info, outputPath: outputPath, pieceLength: info.pieceLength, pieceHash: pieceHash}, nil
+}
+
+func (s *blobStorage) blobPath(hash string) string {
+	return filepath.Join(s.dir, hash+".piece")
+}
+
+func (s *blobStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off%int64(s.pieceLength) != 0 {
+		return 0, fmt.Errorf("blob storage only accepts whole-piece writes, got offset %d", off)
+	}
+
+	index := int(off / int64(s.pieceLength))
+	hash := fmt.Sprintf("%x", sha1.Sum(p))
+
+	if err := os.WriteFile(s.blobPath(hash), p, 0o644); err != nil {
+		return 0, err
+	}
+
+	s.pieceHash[index] = hash
+
+	return len(p), nil
+}
+
+func (s *blobStorage) ReadAt(p []byte, off int64) (int, error) {
+	index := int(off / int64(s.pieceLength))
+	inPieceOffset := off % int64(s.pieceLength)
+
+	hash, ok := s.pieceHash[index]
+	if !ok {
+		return 0, fmt.Errorf("piece %d has not been written yet", index)
+	}
+
+	data, err := os.ReadFile(s.blobPath(hash))
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(p, data[inPieceOffset:])
+	return n, nil
+}
+
+func (s *blobStorage) PieceCompleted(index int) error {
+	return nil
+}
+
+// Close reassembles every piece present in s.pieceHash into the same
+// on-disk layout openOutputFiles would have created, so the blob backend
+// leaves behind a usable output file (or files) like the others do.
+func (s *blobStorage) Close() error {
+	spans, err := openOutputFiles(s.info, s.outputPath)
+	if err != nil {
+		return err
+	}
+	defer closeOutputFiles(spans)
+
+	for index, hash := range s.pieceHash {
+		data, err := os.ReadFile(s.blobPath(hash))
+		if err != nil {
+			return err
+		}
+
+		offset := int64(index) * int64(s.pieceLength)
+		if err := writePieceAcrossFiles(spans, offset, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	udpTrackerMagic                 = 0x41727101980
+	udpActionConnect         uint32 = 0
+	udpActionAnnounce        uint32 = 1
+	udpTrackerInitialBackoff        = 15 * time.Second
+	udpTrackerMaxBackoff            = 15 * (1 << 3) * time.Second // cap per BEP 15's 15*2^n schedule
+	udpTrackerMaxAttempts           = 4
+)
+
+// performUdpPeerDiscovery speaks the BEP 15 UDP tracker protocol: connect,
+// then announce, over the same UDP socket. parsedUrl is the same
+// getPeerDiscoveryUrl result performPeerDiscovery uses for HTTP trackers,
+// just with a udp:// scheme.
+func performUdpPeerDiscovery(parsedUrl *url.URL) []Peer {
+	conn, err := net.Dial("udp", parsedUrl.Host)
+	if err != nil {
+		panic(err)
+	}
+
+	defer conn.Close()
+
+	connectionId, err := udpConnect(conn)
+	if err != nil {
+		panic(err)
+	}
+
+	params := parsedUrl.Query()
+
+	port, err := strconv.Atoi(params.Get("port"))
+	if err != nil {
+		panic(err)
+	}
+
+	left, err := strconv.Atoi(params.Get("left"))
+	if err != nil {
+		panic(err)
+	}
+
+	peers, err := udpAnnounce(conn, connectionId, params.Get("info_hash"), params.Get("peer_id"), uint16(port), int64(left))
+	if err != nil {
+		panic(err)
+	}
+
+	return peers
+}
+
+// udpConnect performs the BEP 15 connect exchange and returns the
+// connection id the tracker assigned, which must be reused for the
+// announce request.
+func udpConnect(conn net.Conn) (uint64, error) {
+	transactionId := rand.Uint32()
+
+	request := make([]byte, 16)
+	binary.BigEndian.PutUint64(request[0:8], udpTrackerMagic)
+	binary.BigEndian.PutUint32(request[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(request[12:16], transactionId)
+
+	response, err := udpRoundTrip(conn, request, 16)
+	if err != nil {
+		return 0, err
+	}
+
+	if binary.BigEndian.Uint32(response[0:4]) != udpActionConnect {
+		return 0, fmt.Errorf("unexpected connect response action")
+	}
+
+	if binary.BigEndian.Uint32(response[4:8]) != transactionId {
+		return 0, fmt.Errorf("connect response transaction id mismatch")
+	}
+
+	return binary.BigEndian.Uint64(response[8:16]), nil
+}
+
+// udpAnnounce sends a BEP 15 announce request and parses the returned peer
+// list out of its compact IPv4/port entries, same format the HTTP tracker
+// path hands to parsePeers.
+func udpAnnounce(conn net.Conn, connectionId uint64, infoHash string, peerId string, port uint16, left int64) ([]Peer, error) {
+	transactionId := rand.Uint32()
+
+	request := make([]byte, 98)
+	binary.BigEndian.PutUint64(request[0:8], connectionId)
+	binary.BigEndian.PutUint32(request[8:12], udpActionAnnounce)
+	binary.BigEndian.PutUint32(request[12:16], transactionId)
+	copy(request[16:36], infoHash)
+	copy(request[36:56], peerId)
+	binary.BigEndian.PutUint64(request[56:64], 0)                  // downloaded
+	binary.BigEndian.PutUint64(request[64:72], uint64(left))       // left
+	binary.BigEndian.PutUint64(request[72:80], 0)                  // uploaded
+	binary.BigEndian.PutUint32(request[80:84], 0)                  // event: none
+	binary.BigEndian.PutUint32(request[84:88], 0)                  // ip: 0, let the tracker use the sender's address
+	binary.BigEndian.PutUint32(request[88:92], rand.Uint32())      // key
+	binary.BigEndian.PutUint32(request[92:96], uint32(0xffffffff)) // num_want: -1
+	binary.BigEndian.PutUint16(request[96:98], port)
+
+	response, err := udpRoundTrip(conn, request, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(response[0:4]) != udpActionAnnounce {
+		return nil, fmt.Errorf("unexpected announce response action")
+	}
+
+	if binary.BigEndian.Uint32(response[4:8]) != transactionId {
+		return nil, fmt.Errorf("announce response transaction id mismatch")
+	}
+
+	return parsePeers(string(response[20:]))
+}
+
+// udpRoundTrip sends request and waits for a reply of at least minLength
+// bytes, resending with exponential backoff (15*2^n seconds, capped) when
+// the tracker doesn't answer in time - UDP delivery isn't guaranteed, and
+// BEP 15 requires clients to tolerate dropped packets this way.
+func udpRoundTrip(conn net.Conn, request []byte, minLength int) ([]byte, error) {
+	backoff := udpTrackerInitialBackoff
+
+	for attempt := 0; attempt < udpTrackerMaxAttempts; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(backoff)); err != nil {
+			return nil, err
+		}
+
+		response := make([]byte, 2048)
+		n, err := conn.Read(response)
+		if err == nil && n >= minLength {
+			return response[:n], nil
+		}
+
+		if backoff < udpTrackerMaxBackoff {
+			backoff *= 2
+		}
+	}
+
+	return nil, fmt.Errorf("udp tracker did not respond after %d attempts", udpTrackerMaxAttempts)
+}